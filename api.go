@@ -6,12 +6,30 @@ import "errors"
 import "fmt"
 import "os"
 import "os/signal"
+import "strconv"
 import "strings"
 import "syscall"
 import "runtime"
+import "sync"
+import "time"
+
+import "github.com/mattn/go-runewidth"
 
 // public API
 
+// Used by Interrupt to wake up any goroutine currently blocked inside
+// PollEvent or PollEventTimeout.
+var interrupt_comm = make(chan struct{}, 1)
+
+// IsInit reports whether Init has completed successfully and Close hasn't
+// been called since. It's guarded by initMu, which also makes Init/Close
+// themselves idempotent: a second Init is a no-op returning nil, and Close
+// is safe to call even if Init never succeeded.
+var (
+	IsInit bool
+	initMu sync.Mutex
+)
+
 // Used to construct palettes from 24-bit RGB values
 type RGB struct{ R, G, B byte }
 
@@ -25,6 +43,186 @@ func SetColorPalette(p []RGB) {
 // A preconfigured palette corresponding to XTERM's defaults
 var Palette256 []RGB
 
+// Attribute is termbox's existing 16-bit color+style type and has no spare
+// bits to hold a packed 24-bit RGB triple, so true color is threaded through
+// as a side table instead: RGBAttribute hands back a small opaque Attribute
+// allocated from the unused tail of the palette-index space (indices 0-256
+// are taken; 257 upward are free), and rgbByAttr maps it back to the real
+// RGB value on demand. That keeps Attribute itself untouched.
+//
+// That tail is finite -- it ends at rgbMarkerMax, one below AttrBold -- so
+// the table is a bounded LRU rather than an ever-growing allocator: once all
+// rgbSlots are in use, RGBAttribute evicts the least-recently-used color
+// instead of handing out a value that would collide with AttrBold/
+// AttrUnderline/AttrReverse. A program juggling more than rgbSlots distinct
+// true-color values on screen at once will see older ones start reusing
+// slots (and so redraw as whichever color currently owns that slot) rather
+// than corrupting style flags.
+const (
+	rgbMarkerBase = Attribute(257)
+	rgbMarkerMax  = AttrBold - 1
+	rgbSlots      = int(rgbMarkerMax-rgbMarkerBase) + 1
+)
+
+var (
+	rgbMu      sync.Mutex
+	rgbByColor = map[RGB]Attribute{}
+	rgbByAttr  = map[Attribute]RGB{}
+	rgbOrder   []Attribute // least-recently-used first
+	rgbNext    = rgbMarkerBase
+)
+
+// rgbTouch moves a to the most-recently-used end of rgbOrder. Callers must
+// hold rgbMu.
+func rgbTouch(a Attribute) {
+	for i, x := range rgbOrder {
+		if x == a {
+			rgbOrder = append(rgbOrder[:i], rgbOrder[i+1:]...)
+			break
+		}
+	}
+	rgbOrder = append(rgbOrder, a)
+}
+
+// RGBAttribute returns an Attribute that SetCell's fg/bg can use to render
+// as the given 24-bit color once SetColorMode(ColorModeTrueColor) has been
+// called. In ColorMode256 it is automatically degraded to the nearest
+// Palette256 entry, and in ColorMode16 to the nearest of Palette256's first
+// 16 entries. Safe to call from multiple goroutines.
+func RGBAttribute(r, g, b byte) Attribute {
+	c := RGB{r, g, b}
+
+	rgbMu.Lock()
+	defer rgbMu.Unlock()
+	if a, ok := rgbByColor[c]; ok {
+		rgbTouch(a)
+		return a
+	}
+
+	var a Attribute
+	if rgbNext <= rgbMarkerMax {
+		a = rgbNext
+		rgbNext++
+	} else {
+		// All rgbSlots are taken: reclaim the least-recently-used one
+		// instead of overrunning into AttrBold/AttrUnderline/AttrReverse.
+		a = rgbOrder[0]
+		rgbOrder = rgbOrder[1:]
+		delete(rgbByColor, rgbByAttr[a])
+	}
+
+	rgbByColor[c] = a
+	rgbByAttr[a] = c
+	rgbOrder = append(rgbOrder, a)
+	return a
+}
+
+// attr_color strips any AttrBold/AttrUnderline/AttrReverse bits off a,
+// leaving just the part that encodes (or, via rgbByAttr, looks up) a color.
+func attr_color(a Attribute) Attribute {
+	return a &^ attrAttrsMask
+}
+
+// attrRGB looks up the RGB triple behind an Attribute returned by
+// RGBAttribute, if any.
+func attrRGB(a Attribute) (c RGB, ok bool) {
+	rgbMu.Lock()
+	c, ok = rgbByAttr[attr_color(a)]
+	rgbMu.Unlock()
+	return c, ok
+}
+
+func attrIsRGB(a Attribute) bool {
+	_, ok := attrRGB(a)
+	return ok
+}
+
+// nearest_palette_attr maps an RGB-tagged Attribute down to the closest
+// entry in the active palette, preserving any style flags and leaving plain
+// palette indices untouched.
+func nearest_palette_attr(a Attribute) Attribute {
+	c, ok := attrRGB(a)
+	if !ok {
+		return a
+	}
+
+	palette := Palette256
+	if color_mode == ColorMode16 {
+		palette = Palette256[:16]
+	}
+
+	best := 0
+	bestDist := -1
+	for i, p := range palette {
+		dr := int(c.R) - int(p.R)
+		dg := int(c.G) - int(p.G)
+		db := int(c.B) - int(p.B)
+		dist := dr*dr + dg*dg + db*db
+		if bestDist == -1 || dist < bestDist {
+			bestDist = dist
+			best = i
+		}
+	}
+	// palette index 0 maps to attribute 1, 0 is ColorDefault
+	return (a & attrAttrsMask) | Attribute(best+1)
+}
+
+// send_true_color_channel emits the SGR sequence for one channel (fg when
+// isFg, else bg): 38/48;2;R;G;B for an RGB-tagged Attribute, otherwise the
+// plain 38/48;5;N palette code (or the 39/49 "default color" reset). It
+// never goes through send_attr, which resets every attribute before
+// reapplying them -- exactly what must not happen here when only one of
+// fg/bg is RGB.
+func send_true_color_channel(a Attribute, isFg bool) {
+	if c, ok := attrRGB(a); ok {
+		if isFg {
+			fmt.Fprintf(&outbuf, "\033[38;2;%d;%d;%dm", c.R, c.G, c.B)
+		} else {
+			fmt.Fprintf(&outbuf, "\033[48;2;%d;%d;%dm", c.R, c.G, c.B)
+		}
+		return
+	}
+
+	idx := attr_color(a)
+	switch {
+	case idx == ColorDefault && isFg:
+		outbuf.WriteString("\033[39m")
+	case idx == ColorDefault:
+		outbuf.WriteString("\033[49m")
+	case isFg:
+		fmt.Fprintf(&outbuf, "\033[38;5;%dm", idx-1)
+	default:
+		fmt.Fprintf(&outbuf, "\033[48;5;%dm", idx-1)
+	}
+}
+
+// send_cell_attr emits the SGR sequence for fg/bg. Outside ColorModeTrueColor
+// (or when neither side carries an RGB triple) it defers to send_attr, with
+// RGB attributes degraded to their nearest palette entry. Otherwise it
+// resets once and writes both channels itself via send_true_color_channel,
+// so a mix of an RGB channel and a plain one (e.g. an RGB foreground over
+// ColorDefault) can't have one clobber the other.
+func send_cell_attr(fg, bg Attribute) {
+	if color_mode != ColorModeTrueColor || (!attrIsRGB(fg) && !attrIsRGB(bg)) {
+		send_attr(nearest_palette_attr(fg), nearest_palette_attr(bg))
+		return
+	}
+
+	outbuf.WriteString(funcs[t_sgr0])
+	send_true_color_channel(fg, true)
+	send_true_color_channel(bg, false)
+	if fg&AttrBold != 0 {
+		outbuf.WriteString("\033[1m")
+	}
+	if fg&AttrUnderline != 0 {
+		outbuf.WriteString("\033[4m")
+	}
+	if fg&AttrReverse != 0 {
+		outbuf.WriteString("\033[7m")
+	}
+	lastfg, lastbg = fg, bg
+}
+
 func init() {
 	var r, g, b byte
 
@@ -92,10 +290,21 @@ func init() {
 	}
 }
 
-// instructs termbox to switch to either ColorMode16 or ColorMode256 
+// ColorModeTrueColor (alias ColorMode24bit) switches termbox to 24-bit RGB
+// output, for terminals that understand "\033[38;2;R;G;Bm" SGR sequences
+// (iTerm2, gnome-terminal, kitty, ...). Cells built with RGBAttribute are
+// emitted verbatim in this mode, and degrade to the nearest Palette256
+// entry in ColorMode256 (the nearest of its first 16 in ColorMode16).
+const (
+	ColorModeTrueColor = ColorMode256 + 1
+	ColorMode24bit     = ColorModeTrueColor
+)
+
+// instructs termbox to switch to either ColorMode16, ColorMode256 or
+// ColorModeTrueColor
 func SetColorMode(cm ColorMode) error {
 	switch cm {
-	case ColorMode16:
+	case ColorMode16, ColorModeTrueColor:
 		color_mode = cm
 		return nil
 	case ColorMode256:
@@ -131,15 +340,33 @@ func SetColorMode(cm ColorMode) error {
 //      }
 //      defer termbox.Close()
 func Init() error {
+	initMu.Lock()
+	defer initMu.Unlock()
+	if IsInit {
+		return nil
+	}
+
 	var err error
 
-	out, err = os.OpenFile("/dev/tty", syscall.O_WRONLY, 0)
-	if err != nil {
-		return err
-	}
-	in, err = syscall.Open("/dev/tty", syscall.O_RDONLY, 0)
-	if err != nil {
-		return err
+	if runtime.GOOS == "openbsd" || runtime.GOOS == "freebsd" {
+		// SIGIO delivery on the read side of a write-only /dev/tty is
+		// unreliable on these kernels, so open it O_RDWR once and reuse
+		// the same fd for both in and out.
+		fd, err := syscall.Open("/dev/tty", syscall.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		out = os.NewFile(uintptr(fd), "/dev/tty")
+		in = fd
+	} else {
+		out, err = os.OpenFile("/dev/tty", syscall.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		in, err = syscall.Open("/dev/tty", syscall.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = setup_term()
@@ -215,12 +442,20 @@ func Init() error {
 		}
 	}()
 
+	IsInit = true
 	return nil
 }
 
 // Finalizes termbox library, should be called after successful initialization
-// when termbox's functionality isn't required anymore.
+// when termbox's functionality isn't required anymore. It is safe to call
+// even if Init was never called or already failed.
 func Close() {
+	initMu.Lock()
+	defer initMu.Unlock()
+	if !IsInit {
+		return
+	}
+
 	quit <- 1
 	out.WriteString(funcs[t_show_cursor])
 	out.WriteString(funcs[t_sgr0])
@@ -230,8 +465,12 @@ func Close() {
 	out.WriteString(funcs[t_exit_mouse])
 	tcsetattr(out.Fd(), &orig_tios)
 
+	// out and in share a single fd on openbsd/freebsd; only close it once.
+	sameFd := int(out.Fd()) == in
 	out.Close()
-	syscall.Close(in)
+	if !sameFd {
+		syscall.Close(in)
+	}
 
 	// reset the state, so that on next Init() it will work again
 	termw = 0
@@ -247,6 +486,10 @@ func Close() {
 	cursor_y = cursor_hidden
 	foreground = ColorDefault
 	background = ColorDefault
+	// combining is keyed by y*width+x; that mapping is meaningless once this
+	// session's width changes on a later Init, so don't carry it across.
+	combining = map[int][]rune{}
+	IsInit = false
 }
 
 // Synchronizes the internal back buffer with the terminal.
@@ -266,20 +509,21 @@ func Flush() error {
 			if back.Ch < ' ' {
 				back.Ch = ' '
 			}
-			w := rune_width(back.Ch)
+			w := runewidth.RuneWidth(back.Ch)
+			oldw := runewidth.RuneWidth(front.Ch)
 			if *back == *front {
 				x += w
 				continue
 			}
 			*front = *back
-			send_attr(back.Fg, back.Bg)
+			send_cell_attr(back.Fg, back.Bg)
 
 			if w == 2 && x == front_buffer.width-1 {
 				// there's not enough space for 2-cells rune,
 				// let's just put a space in there
 				send_char(x, y, ' ')
 			} else {
-				send_char(x, y, back.Ch)
+				send_rune_cluster(x, y, back.Ch, combining[cell_offset])
 				if w == 2 {
 					next := cell_offset + 1
 					front_buffer.cells[next] = Cell{
@@ -287,6 +531,13 @@ func Flush() error {
 						Fg: back.Fg,
 						Bg: back.Bg,
 					}
+				} else if oldw == 2 && x < front_buffer.width-1 {
+					// back.Ch used to be the left half of a wide rune;
+					// its now-orphaned continuation cell must be
+					// invalidated so it gets redrawn too, instead of
+					// silently comparing equal to stale front state
+					next := cell_offset + 1
+					front_buffer.cells[next] = Cell{Ch: invalid_rune}
 				}
 			}
 			x += w
@@ -319,8 +570,33 @@ func HideCursor() {
 	SetCursor(cursor_hidden, cursor_hidden)
 }
 
+// invalid_rune never occurs in real cell content; it's used to force a
+// front-buffer cell to be considered stale and redrawn on the next Flush.
+const invalid_rune = rune(-1)
+
+// combining holds zero-width runes (combining marks, joiners, ...) attached
+// to the cell at a given back-buffer offset, keyed the same way as
+// back_buffer.cells. SetCell merges a zero-width rune into the previous
+// cell instead of giving it a cell of its own; SetCellEx populates it
+// directly for a full grapheme cluster.
+var combining = map[int][]rune{}
+
+// send_rune_cluster draws ch at (x, y) and then appends any combining runes
+// attached to that cell right after it, without moving the cursor again.
+func send_rune_cluster(x, y int, ch rune, extra []rune) {
+	send_char(x, y, ch)
+	for _, r := range extra {
+		outbuf.WriteRune(r)
+	}
+}
+
 // Changes cell's parameters in the internal back buffer at the specified
-// position.
+// position. A zero-width rune (a combining mark or joiner) is not given a
+// cell of its own; it is merged into the cell immediately to the left, same
+// as SetCellEx would for a multi-rune grapheme cluster. At the start of a
+// row there is no cell to merge into, so it is dropped instead -- giving it
+// a cell of its own would leave Flush's "x += runewidth.RuneWidth(ch)" loop
+// unable to advance past it.
 func SetCell(x, y int, ch rune, fg, bg Attribute) {
 	if x < 0 || x >= back_buffer.width {
 		return
@@ -329,7 +605,39 @@ func SetCell(x, y int, ch rune, fg, bg Attribute) {
 		return
 	}
 
-	back_buffer.cells[y*back_buffer.width+x] = Cell{ch, fg, bg}
+	if runewidth.RuneWidth(ch) == 0 {
+		if x > 0 {
+			prev := y*back_buffer.width + (x - 1)
+			combining[prev] = append(combining[prev], ch)
+		}
+		return
+	}
+
+	cell_offset := y*back_buffer.width + x
+	delete(combining, cell_offset)
+	back_buffer.cells[cell_offset] = Cell{ch, fg, bg}
+}
+
+// SetCellEx places a full grapheme cluster at (x, y): chs[0] becomes the
+// cell's primary rune (its width decides how many terminal columns the
+// cluster occupies) and any further runes in chs -- combining marks, a
+// variation selector, a ZWJ sequence -- are drawn immediately after it
+// without taking a cell of their own. Use this for things a single rune
+// can't represent, like flag emoji or "e" + U+0301.
+func SetCellEx(x, y int, chs []rune, fg, bg Attribute) {
+	if len(chs) == 0 {
+		return
+	}
+	SetCell(x, y, chs[0], fg, bg)
+	if x < 0 || x >= back_buffer.width || y < 0 || y >= back_buffer.height {
+		return
+	}
+	cell_offset := y*back_buffer.width + x
+	if len(chs) > 1 {
+		combining[cell_offset] = append([]rune(nil), chs[1:]...)
+	} else {
+		delete(combining, cell_offset)
+	}
 }
 
 // Returns a slice into the termbox's back buffer. You can get its dimensions
@@ -339,32 +647,207 @@ func CellBuffer() []Cell {
 	return back_buffer.cells
 }
 
+// attrAttrsMask covers the style flags (bold/underline/reverse) that SGR
+// parsing preserves across a color change.
+const attrAttrsMask = AttrBold | AttrUnderline | AttrReverse
+
+// set_color replaces the color carried by a, keeping a's style flags.
+func set_color(a, color Attribute) Attribute {
+	return (a & attrAttrsMask) | color
+}
+
+// parse_extended_color interprets a 38/48 SGR introducer at parts[i] (i.e.
+// parts[i] is "38" or "48") and returns the resulting color together with
+// the index of the last parameter it consumed.
+func parse_extended_color(base Attribute, parts []string, i int) (Attribute, int) {
+	if i+1 >= len(parts) {
+		return base, i
+	}
+	switch parts[i+1] {
+	case "5": // 38;5;N / 48;5;N -- 256-color palette index
+		if i+2 < len(parts) {
+			if n, err := strconv.Atoi(parts[i+2]); err == nil {
+				return set_color(base, Attribute(n+1)), i + 2
+			}
+		}
+	case "2": // 38;2;R;G;B / 48;2;R;G;B -- true color
+		if i+4 < len(parts) {
+			r, errR := strconv.Atoi(parts[i+2])
+			g, errG := strconv.Atoi(parts[i+3])
+			b, errB := strconv.Atoi(parts[i+4])
+			if errR == nil && errG == nil && errB == nil {
+				return set_color(base, RGBAttribute(byte(r), byte(g), byte(b))), i + 4
+			}
+		}
+	}
+	return base, i
+}
+
+// apply_sgr splits the parameter string of one CSI "\033[...m" sequence on
+// ';' and folds the parameters into fg/bg, resetting to defaultFg/defaultBg on an
+// SGR reset.
+func apply_sgr(params string, fg, bg, defaultFg, defaultBg Attribute) (Attribute, Attribute) {
+	if params == "" {
+		params = "0"
+	}
+	parts := strings.Split(params, ";")
+	for i := 0; i < len(parts); i++ {
+		code, err := strconv.Atoi(parts[i])
+		if err != nil {
+			continue
+		}
+		switch {
+		case code == 0:
+			fg, bg = defaultFg, defaultBg
+		case code == 1:
+			fg |= AttrBold
+		case code == 4:
+			fg |= AttrUnderline
+		case code == 7:
+			fg |= AttrReverse
+		case code == 22:
+			fg &^= AttrBold
+		case code == 24:
+			fg &^= AttrUnderline
+		case code == 27:
+			fg &^= AttrReverse
+		case code >= 30 && code <= 37:
+			fg = set_color(fg, Attribute(code-30+1))
+		case code == 38:
+			fg, i = parse_extended_color(fg, parts, i)
+		case code == 39:
+			fg = set_color(fg, defaultFg)
+		case code >= 40 && code <= 47:
+			bg = set_color(bg, Attribute(code-40+1))
+		case code == 48:
+			bg, i = parse_extended_color(bg, parts, i)
+		case code == 49:
+			bg = set_color(bg, defaultBg)
+		case code >= 90 && code <= 97:
+			fg = set_color(fg, Attribute(code-90+9))
+		case code >= 100 && code <= 107:
+			bg = set_color(bg, Attribute(code-100+9))
+		}
+	}
+	return fg, bg
+}
+
+// parse_escape is the shared core of ParseEscape and SetCellsFromString: it
+// walks s, applies any CSI SGR sequences it finds to a running fg/bg, and
+// emits one Cell per visible rune. All state is local to the call, so it is
+// safe to use from multiple goroutines at once.
+func parse_escape(s string, defaultFg, defaultBg Attribute) []Cell {
+	fg, bg := defaultFg, defaultBg
+	runes := []rune(s)
+	cells := make([]Cell, 0, len(runes))
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '\033' && i+1 < len(runes) && runes[i+1] == '[' {
+			j := i + 2
+			for j < len(runes) && runes[j] != 'm' {
+				j++
+			}
+			if j < len(runes) {
+				fg, bg = apply_sgr(string(runes[i+2:j]), fg, bg, defaultFg, defaultBg)
+				i = j
+				continue
+			}
+		}
+		cells = append(cells, Cell{Ch: runes[i], Fg: fg, Bg: bg})
+	}
+	return cells
+}
+
+// ParseEscape interprets SGR escape sequences in s (as produced by tools
+// like git diff or syntax highlighters) and returns one Cell per visible
+// rune, so callers can pre-render into their own buffers before copying
+// them into termbox's back buffer.
+func ParseEscape(s string) []Cell {
+	return parse_escape(s, ColorDefault, ColorDefault)
+}
+
+// SetCellsFromString writes s to the back buffer starting at (x, y),
+// interpreting any SGR escape sequences it contains (reset, bold, reverse,
+// underline, the 30-37/40-47 and 90-97/100-107 color ranges, 38;5;N/48;5;N
+// and the 38;2;R;G;B/48;2;R;G;B true-color codes from RGBAttribute) and
+// falling back to defaultFg/defaultBg for any text before the first
+// sequence. Each rune advances the destination column by its own display
+// width (as runewidth.RuneWidth and Flush's own redraw loop see it), not by
+// one, so East-Asian wide runes and emoji in s land where they actually
+// draw. It returns the number of columns s occupies from x, including any
+// that fall past the edge of the back buffer and so are not written.
+func SetCellsFromString(x, y int, s string, defaultFg, defaultBg Attribute) int {
+	cells := parse_escape(s, defaultFg, defaultBg)
+	col := 0
+	for _, c := range cells {
+		SetCell(x+col, y, c.Ch, c.Fg, c.Bg)
+		if w := runewidth.RuneWidth(c.Ch); w > 0 {
+			col += w
+		}
+	}
+	return col
+}
+
+// EventInterrupt is the event type returned by PollEvent and
+// PollEventTimeout when Interrupt has been called, either while the poll was
+// in flight or before it started with no poll in flight.
+const EventInterrupt = EventError + 1
+
 // Wait for an event and return it. This is a blocking function call.
 func PollEvent() Event {
+	event, _ := pollEvent(nil)
+	return event
+}
+
+// Wait for an event and return it, or give up and return false once 'd' has
+// elapsed without one arriving. The returned Event is only meaningful when
+// the bool result is true.
+func PollEventTimeout(d time.Duration) (Event, bool) {
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+	return pollEvent(timeout.C)
+}
+
+// Interrupt causes any in-flight call to PollEvent or PollEventTimeout to
+// return immediately with an Event{Type: EventInterrupt}. It is safe to call
+// from any goroutine, including a signal handler, and never blocks: if no
+// poll is currently in flight the interrupt is simply picked up by the next
+// one.
+func Interrupt() {
+	select {
+	case interrupt_comm <- struct{}{}:
+	default:
+	}
+}
+
+func pollEvent(timeout <-chan time.Time) (Event, bool) {
 	var event Event
 
 	// try to extract event from input buffer, return on success
 	event.Type = EventKey
 	if extract_event(&event) {
-		return event
+		return event, true
 	}
 
 	for {
 		select {
 		case ev := <-input_comm:
 			if ev.err != nil {
-				return Event{Type: EventError, Err: ev.err}
+				return Event{Type: EventError, Err: ev.err}, true
 			}
 
 			inbuf = append(inbuf, ev.data...)
 			input_comm <- ev
 			if extract_event(&event) {
-				return event
+				return event, true
 			}
 		case <-sigwinch:
 			event.Type = EventResize
 			event.Width, event.Height = get_term_size(out.Fd())
-			return event
+			return event, true
+		case <-interrupt_comm:
+			return Event{Type: EventInterrupt}, true
+		case <-timeout:
+			return Event{}, false
 		}
 	}
 	panic("unreachable")
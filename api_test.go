@@ -0,0 +1,195 @@
+// +build !windows
+
+package termbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRGBAttributeRoundTrip(t *testing.T) {
+	a := RGBAttribute(10, 20, 30)
+	c, ok := attrRGB(a)
+	if !ok {
+		t.Fatalf("attrRGB(%v) reported not RGB", a)
+	}
+	if c.R != 10 || c.G != 20 || c.B != 30 {
+		t.Fatalf("got %+v, want {10 20 30}", c)
+	}
+	if RGBAttribute(10, 20, 30) != a {
+		t.Fatalf("RGBAttribute should return the same Attribute for the same color")
+	}
+}
+
+func TestNearestPaletteAttrPreservesFlags(t *testing.T) {
+	color_mode = ColorMode256
+	a := RGBAttribute(255, 255, 255) | AttrBold
+
+	got := nearest_palette_attr(a)
+	if got&AttrBold == 0 {
+		t.Fatalf("nearest_palette_attr dropped AttrBold: %v", got)
+	}
+	if attrIsRGB(got) {
+		t.Fatalf("nearest_palette_attr should degrade to a plain palette index")
+	}
+}
+
+func TestRGBAttributeDoesNotOverrunStyleFlags(t *testing.T) {
+	rgbMu.Lock()
+	rgbByColor = map[RGB]Attribute{}
+	rgbByAttr = map[Attribute]RGB{}
+	rgbOrder = nil
+	rgbNext = rgbMarkerBase
+	rgbMu.Unlock()
+
+	var last Attribute
+	for i := 0; i < rgbSlots+10; i++ {
+		last = RGBAttribute(byte(i), byte(i+1), byte(i+2))
+		if last >= AttrBold {
+			t.Fatalf("RGBAttribute overran into AttrBold after %d colors: got %v", i+1, last)
+		}
+	}
+
+	if !attrIsRGB(last) {
+		t.Fatalf("the most recently allocated color should still be recognized as RGB")
+	}
+	if attrIsRGB(AttrBold) {
+		t.Fatalf("AttrBold must never be mistaken for an RGB attribute")
+	}
+}
+
+func TestAttrIsRGBFalseForPlainAttribute(t *testing.T) {
+	if attrIsRGB(ColorDefault) {
+		t.Fatalf("ColorDefault should not be reported as RGB")
+	}
+	if attrIsRGB(ColorRed) {
+		t.Fatalf("a plain palette color should not be reported as RGB")
+	}
+}
+
+func TestApplySGRSetsColorAndStyle(t *testing.T) {
+	fg, bg := apply_sgr("1;31", ColorDefault, ColorDefault, ColorDefault, ColorDefault)
+	if fg&AttrBold == 0 {
+		t.Fatalf("expected AttrBold set, got %v", fg)
+	}
+	if attr_color(fg) != ColorRed {
+		t.Fatalf("expected fg color ColorRed, got %v", attr_color(fg))
+	}
+	if bg != ColorDefault {
+		t.Fatalf("bg should be untouched by an fg-only sequence, got %v", bg)
+	}
+}
+
+func TestApplySGRResetRestoresDefaults(t *testing.T) {
+	fg, bg := apply_sgr("0", ColorRed, ColorBlue, ColorGreen, ColorYellow)
+	if fg != ColorGreen || bg != ColorYellow {
+		t.Fatalf("SGR reset should restore the passed-in defaults, got fg=%v bg=%v", fg, bg)
+	}
+}
+
+func TestApplySGRTrueColor(t *testing.T) {
+	fg, _ := apply_sgr("38;2;1;2;3", ColorDefault, ColorDefault, ColorDefault, ColorDefault)
+	c, ok := attrRGB(fg)
+	if !ok || c.R != 1 || c.G != 2 || c.B != 3 {
+		t.Fatalf("expected RGB{1,2,3}, got %+v ok=%v", c, ok)
+	}
+}
+
+func TestApplySGR256Palette(t *testing.T) {
+	fg, _ := apply_sgr("38;5;200", ColorDefault, ColorDefault, ColorDefault, ColorDefault)
+	if attr_color(fg) != Attribute(201) {
+		t.Fatalf("expected palette attribute 201, got %v", attr_color(fg))
+	}
+}
+
+func TestParseEscapeTracksColorAcrossSequences(t *testing.T) {
+	cells := ParseEscape("\033[31mhi\033[0m!")
+	if len(cells) != 3 {
+		t.Fatalf("expected 3 cells, got %d", len(cells))
+	}
+	if attr_color(cells[0].Fg) != ColorRed {
+		t.Fatalf("first rune should be red, got %v", cells[0].Fg)
+	}
+	if attr_color(cells[2].Fg) != ColorDefault {
+		t.Fatalf("rune after reset should be back to ColorDefault, got %v", cells[2].Fg)
+	}
+}
+
+func TestSetCellsFromStringTracksDisplayWidth(t *testing.T) {
+	back_buffer.init(10, 1)
+
+	n := SetCellsFromString(0, 0, "中A", ColorDefault, ColorDefault) // wide rune + narrow rune
+	if n != 3 {
+		t.Fatalf("expected 3 columns consumed (2 for the wide rune + 1), got %d", n)
+	}
+	if back_buffer.cells[2].Ch != 'A' {
+		t.Fatalf("the narrow rune after a wide one landed in the wrong cell: %+v", back_buffer.cells[:3])
+	}
+}
+
+func TestSetCellMergesZeroWidthRuneIntoPreviousCell(t *testing.T) {
+	back_buffer.init(5, 1)
+	combining = map[int][]rune{}
+
+	SetCell(0, 0, 'e', ColorDefault, ColorDefault)
+	SetCell(1, 0, '́', ColorDefault, ColorDefault) // combining acute accent
+
+	if back_buffer.cells[1].Ch != 0 {
+		t.Fatalf("a combining mark should not take its own cell, got %+v", back_buffer.cells[1])
+	}
+	if got := combining[0]; len(got) != 1 || got[0] != '́' {
+		t.Fatalf("combining mark wasn't attached to the previous cell: %v", got)
+	}
+}
+
+func TestSetCellDropsZeroWidthRuneAtColumnZero(t *testing.T) {
+	back_buffer.init(5, 1)
+	combining = map[int][]rune{}
+
+	done := make(chan struct{})
+	go func() {
+		SetCell(0, 0, '́', ColorDefault, ColorDefault)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("SetCell did not return for a zero-width rune at column 0")
+	}
+	if back_buffer.cells[0].Ch != 0 {
+		t.Fatalf("a zero-width rune at column 0 should be dropped, not stored: %+v", back_buffer.cells[0])
+	}
+}
+
+func TestInterruptDoesNotBlockWithNothingPolling(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		Interrupt()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Interrupt blocked with no PollEvent/PollEventTimeout in flight")
+	}
+}
+
+func TestPollEventTimeoutExpiresWithoutInput(t *testing.T) {
+	// An Interrupt made with nothing polling (as in the test above) stays
+	// pending and would end this poll early; drain it first.
+	select {
+	case <-interrupt_comm:
+	default:
+	}
+
+	start := time.Now()
+	_, ok := PollEventTimeout(20 * time.Millisecond)
+	if ok {
+		t.Fatalf("expected PollEventTimeout to time out and report false")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("PollEventTimeout returned before its timeout elapsed")
+	}
+}